@@ -2,9 +2,17 @@ package middlewares
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -12,23 +20,154 @@ const (
 	headerName = "X-Traefik-Backend"
 	queryName  = "X-Traefik-Backend"
 	cookieName = "_TRAEFIK_BACKEND"
+
+	// HashModeMD5 hashes "salt+backend" with MD5. This mirrors the scheme
+	// vulcand/oxy uses for its sticky session cookies.
+	HashModeMD5 = "md5"
+	// HashModeHMACSHA256 hashes the backend URL with HMAC-SHA256 keyed by salt.
+	HashModeHMACSHA256 = "hmac-sha256"
+
+	// SourceHeader selects a backend from the X-Traefik-Backend request header.
+	SourceHeader = "header"
+	// SourceQuery selects a backend from the X-Traefik-Backend query string
+	// parameter. Kept for backwards compatibility; leaks into access logs,
+	// referrers and browser history, so SourceHeader is preferred by default.
+	SourceQuery = "query"
 )
 
+// StickyHeaderConfig configures the opaque backend token mode of
+// StickyHeader. When Salt is empty, token hashing is disabled and backend
+// URLs are exposed as-is, preserving the previous behaviour.
+type StickyHeaderConfig struct {
+	// Salt is mixed into the hash so that tokens can't be recomputed by
+	// someone who only knows the backend URL.
+	Salt string
+	// HashMode selects the hashing algorithm. Defaults to HashModeMD5.
+	HashMode string
+	// SourcePriority controls which source wins when a request carries a
+	// backend on more than one of the non-cookie sources (the header and
+	// the query string). An already-present sticky cookie always takes
+	// precedence over both. Defaults to []string{SourceHeader, SourceQuery}.
+	SourcePriority []string
+	// BackendValidator, when set, rejects any backend supplied via the
+	// header, the query string, or SelectBackend that doesn't belong to the
+	// current frontend's backend pool.
+	BackendValidator func(backend string) bool
+}
+
 // StickyHeader is a middleware that adds X-Traefik-Backend header when sticky
 // cookies are used. Also uses X-Traefik-Backend from a query string when a
 // cookie is not present but sticky cookies are being used.
 type StickyHeader struct {
-	next http.Handler
+	next   http.Handler
+	config StickyHeaderConfig
+	tokens *BackendTokenMap
 }
 
 // NewStickyHeader is called at start
-func NewStickyHeader(next http.Handler) *StickyHeader {
-	return &StickyHeader{next}
+func NewStickyHeader(next http.Handler, config StickyHeaderConfig) *StickyHeader {
+	if config.HashMode == "" {
+		config.HashMode = HashModeMD5
+	}
+	if len(config.SourcePriority) == 0 {
+		config.SourcePriority = []string{SourceHeader, SourceQuery}
+	}
+
+	var tokens *BackendTokenMap
+	if config.Salt != "" {
+		tokens = NewBackendTokenMap(config)
+	}
+
+	return &StickyHeader{next: next, config: config, tokens: tokens}
+}
+
+// BackendTokenMap maintains a bidirectional mapping between backend URLs and
+// stable opaque tokens, so that multiple StickyHeader instances serving the
+// same frontend can share one token namespace.
+type BackendTokenMap struct {
+	config StickyHeaderConfig
+
+	mu         sync.RWMutex
+	tokenToURL map[string]string
+	urlToToken map[string]string
+}
+
+// NewBackendTokenMap creates an empty BackendTokenMap for the given config.
+func NewBackendTokenMap(config StickyHeaderConfig) *BackendTokenMap {
+	return &BackendTokenMap{
+		config:     config,
+		tokenToURL: make(map[string]string),
+		urlToToken: make(map[string]string),
+	}
+}
+
+// TokenFor returns the opaque token for backend, registering it if this is
+// the first time backend is seen. A hash collision with a different backend
+// already registered under that token is resolved by keeping the first
+// registration and returning its token, since the caller cannot distinguish
+// the two afterwards anyway.
+func (m *BackendTokenMap) TokenFor(backend string) string {
+	m.mu.RLock()
+	if token, ok := m.urlToToken[backend]; ok {
+		m.mu.RUnlock()
+		return token
+	}
+	m.mu.RUnlock()
+
+	token := m.hash(backend)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existing, ok := m.tokenToURL[token]; ok && existing != backend {
+		// Collision: the token is already bound to a different backend.
+		// Keep the existing mapping so resolution stays deterministic.
+		return token
+	}
+
+	m.tokenToURL[token] = backend
+	m.urlToToken[backend] = token
+
+	return token
+}
+
+// BackendFor resolves an opaque token back into a backend URL. ok is false
+// when the token is unknown.
+func (m *BackendTokenMap) BackendFor(token string) (backend string, ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	backend, ok = m.tokenToURL[token]
+	return backend, ok
+}
+
+func (m *BackendTokenMap) hash(backend string) string {
+	switch m.config.HashMode {
+	case HashModeHMACSHA256:
+		mac := hmac.New(sha256.New, []byte(m.config.Salt))
+		mac.Write([]byte(backend))
+		return hex.EncodeToString(mac.Sum(nil))
+	default:
+		sum := md5.Sum([]byte(m.config.Salt + backend))
+		return hex.EncodeToString(sum[:])
+	}
 }
 
 type backendHeaderWriter struct {
 	http.ResponseWriter
 	backendFromQueryString string
+	tokens                 *BackendTokenMap
+	websocketSubprotocol   string
+}
+
+// expose converts a backend URL into whatever representation should be sent
+// to the client: the raw URL when token mode is disabled, or an opaque token
+// bound to it otherwise.
+func (w *backendHeaderWriter) expose(backend string) string {
+	if w.tokens == nil {
+		return backend
+	}
+	return w.tokens.TokenFor(backend)
 }
 
 func (w *backendHeaderWriter) WriteHeader(status int) {
@@ -37,8 +176,11 @@ func (w *backendHeaderWriter) WriteHeader(status int) {
 		tempCookie := &http.Cookie{Name: cookieName, Value: "", Path: "/socket.io", MaxAge: 0, Expires: time.Now().Add(-100 * time.Hour)}
 		http.SetCookie(w.ResponseWriter, tempCookie)
 
-		// Found backend location cookie. Adding it to headers.
-		w.ResponseWriter.Header().Set(headerName, backendLocation)
+		// Found backend location cookie. Replace it with the opaque token (if
+		// token mode is enabled) and mirror it onto the header.
+		token := w.expose(backendLocation)
+		w.setResponseCookieValue(cookieName, backendLocation, token)
+		w.ResponseWriter.Header().Set(headerName, token)
 	} else if w.backendFromQueryString != "" {
 		// Temporary: Deleting /socket.io/ cookie. We're using sticky cookies with / path only.
 		tempCookie := &http.Cookie{Name: cookieName, Value: "", Path: "/socket.io", MaxAge: 0, Expires: time.Now().Add(-100 * time.Hour)}
@@ -46,9 +188,10 @@ func (w *backendHeaderWriter) WriteHeader(status int) {
 
 		// Backend location from the query string was valid. Add it to Set-Cookie
 		// header to ensure cookies and headers are in sync.
-		cookie := &http.Cookie{Name: cookieName, Value: w.backendFromQueryString, Path: "/"}
+		token := w.expose(w.backendFromQueryString)
+		cookie := &http.Cookie{Name: cookieName, Value: token, Path: "/"}
 		http.SetCookie(w.ResponseWriter, cookie)
-		w.ResponseWriter.Header().Set(headerName, w.backendFromQueryString)
+		w.ResponseWriter.Header().Set(headerName, token)
 	}
 
 	w.ResponseWriter.WriteHeader(status)
@@ -60,60 +203,339 @@ func (w *backendHeaderWriter) Flush() {
 	}
 }
 
+// Hijack hands back a net.Conn that injects the echoed sticky
+// Sec-WebSocket-Protocol into the 101 response line. A real upgrader (e.g.
+// httputil.ReverseProxy.handleUpgradeResponse) hijacks the connection and
+// writes the 101 response directly to it, bypassing WriteHeader entirely, so
+// that's the only place this can reliably run.
 func (w *backendHeaderWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	return w.ResponseWriter.(http.Hijacker).Hijack()
+	conn, brw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil || w.websocketSubprotocol == "" {
+		return conn, brw, err
+	}
+
+	wrapped := &subprotocolInjectingConn{Conn: conn, subprotocol: w.websocketSubprotocol}
+
+	// Preserve any request bytes already buffered by brw.Reader so nothing
+	// is lost by swapping in a fresh bufio.ReadWriter around wrapped.
+	buffered, _ := brw.Reader.Peek(brw.Reader.Buffered())
+	reader := bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn))
+
+	return wrapped, bufio.NewReadWriter(reader, bufio.NewWriter(wrapped)), nil
+}
+
+// maxUpgradeHeaderBuffer caps how much of the 101 response line and headers
+// subprotocolInjectingConn will buffer while looking for the header
+// terminator, so a malformed or chunked-oddly upgrade response can't grow
+// the buffer unbounded.
+const maxUpgradeHeaderBuffer = 8 * 1024
+
+// subprotocolInjectingConn wraps a hijacked connection and, the first time
+// the upgrade response's status line and headers are written, inserts a
+// Sec-WebSocket-Protocol header echoing the sticky backend token if the
+// response is a 101 Switching Protocols. It buffers writes until it has seen
+// the blank line terminating the headers, since that can arrive split across
+// more than one Write call.
+type subprotocolInjectingConn struct {
+	net.Conn
+	subprotocol string
+	buf         []byte
+	resolved    bool
+}
+
+func (c *subprotocolInjectingConn) Write(p []byte) (int, error) {
+	if c.resolved {
+		return c.Conn.Write(p)
+	}
+
+	c.buf = append(c.buf, p...)
+
+	idx := bytes.Index(c.buf, []byte("\r\n\r\n"))
+	if idx < 0 && len(c.buf) <= maxUpgradeHeaderBuffer {
+		// Still accumulating the status line and headers.
+		return len(p), nil
+	}
+
+	c.resolved = true
+	if idx >= 0 && bytes.Contains(c.buf[:idx], []byte(" 101 ")) {
+		injected := []byte("\r\nSec-WebSocket-Protocol: " + c.subprotocol)
+		head := make([]byte, 0, len(c.buf)+len(injected))
+		head = append(head, c.buf[:idx]...)
+		head = append(head, injected...)
+		c.buf = append(head, c.buf[idx:]...)
+	}
+
+	out := c.buf
+	c.buf = nil
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
 func (sh *StickyHeader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	backendFromQueryString := ""
 
+	sh.resolveIncomingCookie(req)
+
 	if _, err := req.Cookie(cookieName); err == http.ErrNoCookie {
-		// Cookie is not set. Checking query string for the backend.
-		queryValues := req.URL.Query()
-		if backendLocation := queryValues.Get(queryName); backendLocation != "" {
-			// Found the backend from the query string. Storing for later use.
-			backendFromQueryString = backendLocation
+		// Cookie is not set. Falling back to the configured source priority.
+		if backend, ok := sh.selectFromSources(req); ok {
+			backendFromQueryString = backend
 
 			// Setting the backend as a cookie for the sticky module to work.
-			cookie := &http.Cookie{Name: cookieName, Value: backendLocation}
+			cookie := &http.Cookie{Name: cookieName, Value: backend}
 			req.AddCookie(cookie)
 		}
 	}
 
-	writer := &backendHeaderWriter{w, backendFromQueryString}
+	websocketSubprotocol := sh.resolveWebsocketSubprotocol(req)
+
+	writer := &backendHeaderWriter{
+		ResponseWriter:         w,
+		backendFromQueryString: backendFromQueryString,
+		tokens:                 sh.tokens,
+		websocketSubprotocol:   websocketSubprotocol,
+	}
 	writer.addOrAppendHeader("Access-Control-Expose-Headers", headerName)
 	sh.next.ServeHTTP(writer, req)
 }
 
-// Extracted from https://golang.org/src/net/http/cookie.go #readSetCookies for
-// extracing cookie value.
-func (w *backendHeaderWriter) getResponseCookieByName(name string) string {
-	headers := w.ResponseWriter.Header()
-	setCookies := headers["Set-Cookie"]
+// selectFromSources looks up a backend on the non-cookie sources listed in
+// config.SourcePriority, in order, returning the first that resolves to a
+// known backend and passes BackendValidator.
+func (sh *StickyHeader) selectFromSources(req *http.Request) (backend string, ok bool) {
+	for _, source := range sh.config.SourcePriority {
+		var raw string
+		switch source {
+		case SourceHeader:
+			raw = req.Header.Get(headerName)
+		case SourceQuery:
+			raw = req.URL.Query().Get(queryName)
+		}
+		if raw == "" {
+			continue
+		}
 
-	for _, cookie := range setCookies {
-		parts := strings.Split(strings.TrimSpace(cookie), ";")
-		if len(parts) == 1 && parts[0] == "" {
+		resolved, ok := sh.resolve(raw)
+		if !ok || !sh.validate(resolved) {
 			continue
 		}
 
-		parts[0] = strings.TrimSpace(parts[0])
+		return resolved, true
+	}
+
+	return "", false
+}
+
+// validate reports whether backend may be pinned. With no BackendValidator
+// configured, every resolved backend is accepted.
+func (sh *StickyHeader) validate(backend string) bool {
+	if sh.config.BackendValidator == nil {
+		return true
+	}
+	return sh.config.BackendValidator(backend)
+}
+
+// SelectBackend pins req to backend ahead of any header/query lookup,
+// letting other middlewares (auth, canary routing) force a routing decision
+// before ServeHTTP dispatches. It returns an error if a BackendValidator is
+// configured and rejects backend.
+//
+// The cookie is set to backend's exposed form (the opaque token when token
+// mode is enabled) rather than the raw URL, because resolveIncomingCookie
+// runs ahead of ServeHTTP dispatch and, in token mode, expects every
+// incoming sticky cookie to carry a token: a raw URL would fail resolution
+// there and get stripped before the pin ever took effect.
+func (sh *StickyHeader) SelectBackend(req *http.Request, backend string) error {
+	if !sh.validate(backend) {
+		return fmt.Errorf("stickyheader: backend %q is not part of the frontend's backend pool", backend)
+	}
 
-		j := strings.Index(parts[0], "=")
-		if j < 0 {
+	setRequestCookie(req, cookieName, sh.expose(backend))
+	return nil
+}
+
+// expose converts a backend URL into whatever representation a sticky
+// cookie should carry: the raw URL when token mode is disabled, or an
+// opaque token bound to it otherwise. Mirrors backendHeaderWriter.expose,
+// which does the same thing for the response side.
+func (sh *StickyHeader) expose(backend string) string {
+	if sh.tokens == nil {
+		return backend
+	}
+	return sh.tokens.TokenFor(backend)
+}
+
+// websocketBackendSubprotocolPrefix marks a Sec-WebSocket-Protocol entry as
+// carrying a sticky backend token rather than an application protocol, e.g.
+// "traefik-backend.<token>".
+const websocketBackendSubprotocolPrefix = "traefik-backend."
+
+// resolveWebsocketSubprotocol looks for a traefik-backend.<token> entry in
+// the request's Sec-WebSocket-Protocol header. If found and the token
+// resolves to a known backend that passes BackendValidator, it pins req to
+// that backend via a cookie (the
+// same way the query-string path does) and returns the subprotocol entry so
+// it can be echoed back once the upgrade succeeds.
+func (sh *StickyHeader) resolveWebsocketSubprotocol(req *http.Request) string {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return ""
+	}
+
+	for _, protocol := range strings.Split(req.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		protocol = strings.TrimSpace(protocol)
+		if !strings.HasPrefix(protocol, websocketBackendSubprotocolPrefix) {
 			continue
 		}
 
-		name, value := parts[0][:j], parts[0][j+1:]
-
-		if name == cookieName {
-			return value
+		token := strings.TrimPrefix(protocol, websocketBackendSubprotocolPrefix)
+		backend, ok := sh.resolve(token)
+		if !ok || !sh.validate(backend) {
+			continue
 		}
+
+		setRequestCookie(req, cookieName, backend)
+		return protocol
 	}
 
 	return ""
 }
 
+// setRequestCookie sets name to value on req, replacing any cookie already
+// carrying that name instead of appending a duplicate. http.Request.Cookie
+// returns the first match, so an appended duplicate would leave a stale
+// value in place rather than overriding it.
+func setRequestCookie(req *http.Request, name, value string) {
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+
+	replaced := false
+	for _, c := range cookies {
+		if c.Name == name {
+			c.Value = value
+			replaced = true
+		}
+		req.AddCookie(c)
+	}
+	if !replaced {
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+}
+
+// resolve turns an opaque token back into a backend URL. When token mode is
+// disabled, value is already the backend URL and is returned as-is.
+func (sh *StickyHeader) resolve(value string) (backend string, ok bool) {
+	if sh.tokens == nil {
+		return value, true
+	}
+	return sh.tokens.BackendFor(value)
+}
+
+// resolveIncomingCookie replaces an incoming sticky cookie holding an opaque
+// token with the backend URL it maps to, so downstream sticky routing keeps
+// working unmodified. It also runs the resolved backend through
+// BackendValidator: the cookie is entirely client-controlled, so without
+// this a forged cookie would bypass the validation selectFromSources and
+// SelectBackend already enforce. An unknown token or a backend that fails
+// validation is removed so the request falls through as if no sticky cookie
+// had been sent at all.
+func (sh *StickyHeader) resolveIncomingCookie(req *http.Request) {
+	if sh.tokens == nil && sh.config.BackendValidator == nil {
+		return
+	}
+
+	cookie, err := req.Cookie(cookieName)
+	if err == http.ErrNoCookie {
+		return
+	}
+
+	backend, ok := sh.resolve(cookie.Value)
+	if ok && !sh.validate(backend) {
+		ok = false
+	}
+
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name == cookieName {
+			if !ok {
+				continue
+			}
+			c.Value = backend
+		}
+		req.AddCookie(c)
+	}
+}
+
+// pendingCookies parses the Set-Cookie headers accumulated so far on the
+// response by delegating to http.Response.Cookies(), the same parser
+// net/http uses on the client side, instead of hand-rolling cookie parsing.
+// This correctly handles quoting, attributes, and multiple cookies sharing
+// a name.
+func (w *backendHeaderWriter) pendingCookies() []*http.Cookie {
+	response := &http.Response{Header: w.ResponseWriter.Header()}
+	return response.Cookies()
+}
+
+// getResponseCookiesByName returns every pending Set-Cookie matching name,
+// in the order they were set. A frontend may pin more than one path-scoped
+// sticky cookie (e.g. one for "/socket.io/" and one for "/") at once.
+func (w *backendHeaderWriter) getResponseCookiesByName(name string) []*http.Cookie {
+	var matches []*http.Cookie
+	for _, cookie := range w.pendingCookies() {
+		if cookie.Name == name {
+			matches = append(matches, cookie)
+		}
+	}
+	return matches
+}
+
+// getResponseCookieByName returns the value of the first pending Set-Cookie
+// matching name, or "" if none is set.
+func (w *backendHeaderWriter) getResponseCookieByName(name string) string {
+	cookies := w.getResponseCookiesByName(name)
+	if len(cookies) == 0 {
+		return ""
+	}
+	return cookies[0].Value
+}
+
+// setResponseCookieValue rewrites the value portion of the single pending
+// Set-Cookie header matching name whose current value is oldValue, in
+// place, leaving the rest of the header line (and every other Set-Cookie
+// header) untouched. It deliberately doesn't round-trip through
+// http.Cookie: a parse/re-serialize cycle drops any attribute http.Cookie
+// can't model (e.g. Priority, Partitioned).
+//
+// Matching on oldValue, not just name, matters because a frontend may pin
+// more than one same-named cookie at once (e.g. distinct path-scoped
+// assignments, or the /socket.io/ deletion placeholder a few lines up in
+// WriteHeader): rewriting every entry sharing the name would collapse them
+// all to the same value, including un-deleting a cookie that was just
+// cleared to an empty value.
+func (w *backendHeaderWriter) setResponseCookieValue(name, oldValue, newValue string) {
+	header := w.ResponseWriter.Header()
+	cookies := header["Set-Cookie"]
+	prefix := name + "="
+	for i, raw := range cookies {
+		if !strings.HasPrefix(raw, prefix) {
+			continue
+		}
+		rest := raw[len(prefix):]
+		value, attrs := rest, ""
+		if idx := strings.Index(rest, ";"); idx >= 0 {
+			value, attrs = rest[:idx], rest[idx:]
+		}
+		if value != oldValue {
+			continue
+		}
+
+		cookies[i] = prefix + newValue + attrs
+		return
+	}
+}
+
 func (w *backendHeaderWriter) addOrAppendHeader(name string, value string) {
 	if currentValue := w.ResponseWriter.Header().Get(name); currentValue != "" {
 		newValue := strings.Join([]string{currentValue, value}, ", ")
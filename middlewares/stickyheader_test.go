@@ -1,18 +1,21 @@
 package middlewares
 
 import (
+	"bufio"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestStickyHeaderWhenNoStickiness(t *testing.T) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
-	stickyHeader := NewStickyHeader(handler)
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{})
 	responseWriter := httptest.NewRecorder()
 
 	request, _ := http.NewRequest("GET", "http://example.com", nil)
@@ -30,7 +33,7 @@ func TestStickyHeaderSetWhenResponseHasStickyCookie(t *testing.T) {
 		http.SetCookie(w, &cookie)
 		w.WriteHeader(http.StatusOK)
 	})
-	stickyHeader := NewStickyHeader(handler)
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{})
 	responseWriter := httptest.NewRecorder()
 
 	request, _ := http.NewRequest("GET", "http://example.com", nil)
@@ -50,7 +53,7 @@ func TestStickyHeaderSetWhenResponseHasStickyCookieWithPath(t *testing.T) {
 		http.SetCookie(w, &cookie)
 		w.WriteHeader(http.StatusOK)
 	})
-	stickyHeader := NewStickyHeader(handler)
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{})
 	responseWriter := httptest.NewRecorder()
 
 	request, _ := http.NewRequest("GET", "http://example.com", nil)
@@ -68,7 +71,7 @@ func TestStickyHeaderSetWhenRequestWithBackendHeader(t *testing.T) {
 		assert.Equal(t, "http://1.2.3.4", cookie.Value, "should have a request cookie")
 		w.WriteHeader(http.StatusOK)
 	})
-	stickyHeader := NewStickyHeader(handler)
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{})
 	responseWriter := httptest.NewRecorder()
 
 	request, _ := http.NewRequest("GET", "http://example.com?X-Traefik-Backend=http://1.2.3.4", nil)
@@ -82,7 +85,7 @@ func TestStickyHeaderSetsResponseCookieWhenValidCustomHeader(t *testing.T) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
-	stickyHeader := NewStickyHeader(handler)
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{})
 	responseWriter := httptest.NewRecorder()
 
 	request, _ := http.NewRequest("GET", "http://example.com?X-Traefik-Backend=http://1.2.3.4", nil)
@@ -102,7 +105,7 @@ func TestStickyHeaderSetsResponseCookieWhenInvalidCustomHeader(t *testing.T) {
 		http.SetCookie(w, &cookie)
 		w.WriteHeader(http.StatusOK)
 	})
-	stickyHeader := NewStickyHeader(handler)
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{})
 	responseWriter := httptest.NewRecorder()
 
 	request, _ := http.NewRequest("GET", "http://example.com?X-Traefik-Backend=http://1.2.3.4", nil)
@@ -122,7 +125,7 @@ func TestStickyHeaderPrefersBackendFromCookie(t *testing.T) {
 		assert.Equal(t, "http://0.0.0.2", cookie.Value, "should have a backend from cookie")
 		w.WriteHeader(http.StatusOK)
 	})
-	stickyHeader := NewStickyHeader(handler)
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{})
 	responseWriter := httptest.NewRecorder()
 
 	request, _ := http.NewRequest("GET", "http://example.com?X-Traefik-Backend=http://0.0.0.1", nil)
@@ -137,6 +140,382 @@ func TestStickyHeaderPrefersBackendFromCookie(t *testing.T) {
 	assert.Equal(t, 0, len(response.Header["X-Traefik-Backend"]), "should have no sticky header")
 }
 
+func TestStickyHeaderEmitsOpaqueTokenInsteadOfBackend(t *testing.T) {
+	backend := "http://1.2.3.4"
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie := http.Cookie{Name: "_TRAEFIK_BACKEND", Value: backend}
+		http.SetCookie(w, &cookie)
+		w.WriteHeader(http.StatusOK)
+	})
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{Salt: "secret"})
+	responseWriter := httptest.NewRecorder()
+
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	stickyHeader.ServeHTTP(responseWriter, request)
+
+	response := responseWriter.Result()
+	token := response.Header.Get("X-Traefik-Backend")
+	assert.NotEqual(t, backend, token, "backend URL should not be exposed")
+	assert.NotEmpty(t, token, "should have an opaque token header")
+	assert.Equal(t, token, getResponseCookieByName(response, "_TRAEFIK_BACKEND"), "cookie and header tokens should match")
+
+	resolved, ok := stickyHeader.tokens.BackendFor(token)
+	assert.True(t, ok, "token should resolve back to the backend")
+	assert.Equal(t, backend, resolved, "token should resolve to the original backend")
+}
+
+func TestStickyHeaderResolvesIncomingTokenToBackend(t *testing.T) {
+	backend := "http://1.2.3.4"
+
+	var seenCookie string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, _ := r.Cookie("_TRAEFIK_BACKEND")
+		if cookie != nil {
+			seenCookie = cookie.Value
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{Salt: "secret"})
+	token := stickyHeader.tokens.TokenFor(backend)
+
+	responseWriter := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	request.AddCookie(&http.Cookie{Name: "_TRAEFIK_BACKEND", Value: token})
+	stickyHeader.ServeHTTP(responseWriter, request)
+
+	assert.Equal(t, backend, seenCookie, "downstream should see the real backend, not the token")
+}
+
+func TestStickyHeaderFallsThroughOnUnknownToken(t *testing.T) {
+	var sawCookie bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := r.Cookie("_TRAEFIK_BACKEND")
+		sawCookie = err == nil
+		w.WriteHeader(http.StatusOK)
+	})
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{Salt: "secret"})
+
+	responseWriter := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	request.AddCookie(&http.Cookie{Name: "_TRAEFIK_BACKEND", Value: "not-a-known-token"})
+	stickyHeader.ServeHTTP(responseWriter, request)
+
+	assert.False(t, sawCookie, "unknown token should be dropped, not forwarded as a backend")
+}
+
+func TestBackendTokenMapCollisionKeepsFirstBackend(t *testing.T) {
+	tokens := NewBackendTokenMap(StickyHeaderConfig{Salt: "secret"})
+
+	backendA := "http://1.2.3.4"
+	backendB := "http://5.6.7.8"
+
+	// Pretend backendB hashes to the same token as an already-registered
+	// backendA, which the real hash functions would only do by chance.
+	collidingToken := tokens.hash(backendB)
+	tokens.mu.Lock()
+	tokens.tokenToURL[collidingToken] = backendA
+	tokens.mu.Unlock()
+
+	token := tokens.TokenFor(backendB)
+	assert.Equal(t, collidingToken, token, "colliding backend should still get a token")
+
+	resolved, ok := tokens.BackendFor(token)
+	assert.True(t, ok)
+	assert.Equal(t, backendA, resolved, "first registered backend should win on collision")
+}
+
+func TestGetResponseCookieByNameHandlesQuotedValue(t *testing.T) {
+	responseWriter := httptest.NewRecorder()
+	responseWriter.Header().Add("Set-Cookie", `_TRAEFIK_BACKEND="http://1.2.3.4"; Path=/`)
+	writer := &backendHeaderWriter{ResponseWriter: responseWriter}
+
+	assert.Equal(t, "http://1.2.3.4", writer.getResponseCookieByName(cookieName))
+}
+
+func TestGetResponseCookiesByNameReturnsAllDuplicates(t *testing.T) {
+	responseWriter := httptest.NewRecorder()
+	responseWriter.Header().Add("Set-Cookie", "_TRAEFIK_BACKEND=http://1.2.3.4; Path=/")
+	responseWriter.Header().Add("Set-Cookie", "_TRAEFIK_BACKEND=http://5.6.7.8; Path=/socket.io")
+	writer := &backendHeaderWriter{ResponseWriter: responseWriter}
+
+	cookies := writer.getResponseCookiesByName(cookieName)
+	assert.Len(t, cookies, 2, "should see both same-named cookies")
+	assert.Equal(t, "/", cookies[0].Path)
+	assert.Equal(t, "/socket.io", cookies[1].Path)
+}
+
+func TestGetResponseCookieByNameIgnoresSemicolonInsideQuotedAttribute(t *testing.T) {
+	responseWriter := httptest.NewRecorder()
+	responseWriter.Header().Add("Set-Cookie", `_TRAEFIK_BACKEND=http://1.2.3.4; Path=/; Comment="a; b"`)
+	writer := &backendHeaderWriter{ResponseWriter: responseWriter}
+
+	assert.Equal(t, "http://1.2.3.4", writer.getResponseCookieByName(cookieName))
+}
+
+func TestSetResponseCookieValuePreservesAttributesAndOtherCookies(t *testing.T) {
+	responseWriter := httptest.NewRecorder()
+	responseWriter.Header().Add("Set-Cookie", "_TRAEFIK_BACKEND=http://1.2.3.4; Path=/; HttpOnly; Priority=High")
+	unrelated := "unrelated=keep-me; Path=/; SameSite=Strict; Partitioned"
+	responseWriter.Header().Add("Set-Cookie", unrelated)
+	writer := &backendHeaderWriter{ResponseWriter: responseWriter}
+
+	writer.setResponseCookieValue(cookieName, "http://1.2.3.4", "token-abc")
+
+	// Non-standard attributes like Priority and Partitioned aren't modeled by
+	// http.Cookie, so a round trip through it would silently drop them. Check
+	// the raw header value to make sure setResponseCookieValue only spliced
+	// the value rather than re-serializing the whole cookie.
+	setCookies := responseWriter.Header()["Set-Cookie"]
+	assert.Len(t, setCookies, 2)
+	assert.Equal(t, "_TRAEFIK_BACKEND=token-abc; Path=/; HttpOnly; Priority=High", setCookies[0])
+	assert.Equal(t, unrelated, setCookies[1], "unrelated cookies must be left byte-for-byte untouched")
+}
+
+func TestSetResponseCookieValueOnlyTargetsMatchingValue(t *testing.T) {
+	responseWriter := httptest.NewRecorder()
+	responseWriter.Header().Add("Set-Cookie", "_TRAEFIK_BACKEND=http://1.2.3.4; Path=/")
+	responseWriter.Header().Add("Set-Cookie", "_TRAEFIK_BACKEND=; Path=/socket.io; Max-Age=0")
+	responseWriter.Header().Add("Set-Cookie", "_TRAEFIK_BACKEND=http://5.6.7.8; Path=/socket.io")
+	writer := &backendHeaderWriter{ResponseWriter: responseWriter}
+
+	writer.setResponseCookieValue(cookieName, "http://1.2.3.4", "token-abc")
+
+	setCookies := responseWriter.Header()["Set-Cookie"]
+	assert.Equal(t, "_TRAEFIK_BACKEND=token-abc; Path=/", setCookies[0])
+	assert.Equal(t, "_TRAEFIK_BACKEND=; Path=/socket.io; Max-Age=0", setCookies[1], "the /socket.io deletion placeholder must not be un-deleted")
+	assert.Equal(t, "_TRAEFIK_BACKEND=http://5.6.7.8; Path=/socket.io", setCookies[2], "a differently-valued cookie sharing the name must be left alone")
+}
+
+// TestStickyHeaderEchoesWebsocketBackendSubprotocol exercises the real
+// upgrade path: a handler that hijacks the connection and writes the 101
+// response line itself, the way httputil.ReverseProxy.handleUpgradeResponse
+// does, rather than calling ResponseWriter.WriteHeader. A ResponseRecorder
+// can't stand in for this since it doesn't implement http.Hijacker.
+func TestStickyHeaderEchoesWebsocketBackendSubprotocol(t *testing.T) {
+	var sawCookie string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie("_TRAEFIK_BACKEND"); err == nil {
+			sawCookie = cookie.Value
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n\r\n"))
+		require.NoError(t, err)
+	})
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{})
+	server := httptest.NewServer(stickyHeader)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Sec-WebSocket-Protocol", "chat, traefik-backend.http://1.2.3.4")
+	require.NoError(t, request.Write(conn))
+
+	response, err := http.ReadResponse(bufio.NewReader(conn), request)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+	assert.Equal(t, "http://1.2.3.4", sawCookie, "downstream should see the resolved backend as a cookie")
+	assert.Equal(t, "traefik-backend.http://1.2.3.4", response.Header.Get("Sec-WebSocket-Protocol"), "should echo the sticky subprotocol back")
+}
+
+func TestStickyHeaderIgnoresUnknownWebsocketBackendToken(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Upgrade", "websocket")
+		w.WriteHeader(http.StatusSwitchingProtocols)
+	})
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{Salt: "secret"})
+
+	responseWriter := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Protocol", "traefik-backend.not-a-known-token")
+	stickyHeader.ServeHTTP(responseWriter, request)
+
+	response := responseWriter.Result()
+	assert.Equal(t, "", response.Header.Get("Sec-WebSocket-Protocol"), "unknown token should not be echoed")
+}
+
+func TestStickyHeaderIgnoresSubprotocolWithoutWebsocketUpgrade(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{})
+
+	responseWriter := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	request.Header.Set("Sec-WebSocket-Protocol", "traefik-backend.http://1.2.3.4")
+	stickyHeader.ServeHTTP(responseWriter, request)
+
+	response := responseWriter.Result()
+	assert.Equal(t, "", response.Header.Get("Sec-WebSocket-Protocol"))
+}
+
+func TestStickyHeaderWebsocketSubprotocolReplacesStaleCookie(t *testing.T) {
+	var seen string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, _ := r.Cookie(cookieName)
+		seen = cookie.Value
+		w.WriteHeader(http.StatusOK)
+	})
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{})
+
+	responseWriter := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	request.AddCookie(&http.Cookie{Name: cookieName, Value: "http://stale-backend"})
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Protocol", "traefik-backend.http://fresh-backend")
+	stickyHeader.ServeHTTP(responseWriter, request)
+
+	assert.Equal(t, "http://fresh-backend", seen, "a freshly resolved reconnect backend must win over a stale cookie")
+	assert.Len(t, request.Cookies(), 1, "the stale cookie must be replaced, not duplicated")
+}
+
+func TestStickyHeaderPrefersHeaderOverQueryByDefault(t *testing.T) {
+	var seen string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, _ := r.Cookie("_TRAEFIK_BACKEND")
+		seen = cookie.Value
+		w.WriteHeader(http.StatusOK)
+	})
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{})
+
+	responseWriter := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://example.com?X-Traefik-Backend=http://0.0.0.1", nil)
+	request.Header.Set("X-Traefik-Backend", "http://0.0.0.2")
+	stickyHeader.ServeHTTP(responseWriter, request)
+
+	assert.Equal(t, "http://0.0.0.2", seen, "header should win over query string by default")
+}
+
+func TestStickyHeaderRespectsCustomSourcePriority(t *testing.T) {
+	var seen string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, _ := r.Cookie("_TRAEFIK_BACKEND")
+		seen = cookie.Value
+		w.WriteHeader(http.StatusOK)
+	})
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{SourcePriority: []string{SourceQuery, SourceHeader}})
+
+	responseWriter := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://example.com?X-Traefik-Backend=http://0.0.0.1", nil)
+	request.Header.Set("X-Traefik-Backend", "http://0.0.0.2")
+	stickyHeader.ServeHTTP(responseWriter, request)
+
+	assert.Equal(t, "http://0.0.0.1", seen, "query string should win when given priority")
+}
+
+func TestStickyHeaderRejectsBackendOutsidePool(t *testing.T) {
+	var sawCookie bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := r.Cookie("_TRAEFIK_BACKEND")
+		sawCookie = err == nil
+		w.WriteHeader(http.StatusOK)
+	})
+	validator := func(backend string) bool { return backend == "http://allowed" }
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{BackendValidator: validator})
+
+	responseWriter := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	request.Header.Set("X-Traefik-Backend", "http://not-allowed")
+	stickyHeader.ServeHTTP(responseWriter, request)
+
+	assert.False(t, sawCookie, "backend rejected by the validator must not be pinned")
+}
+
+func TestStickyHeaderAcceptsBackendInPool(t *testing.T) {
+	var seen string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, _ := r.Cookie("_TRAEFIK_BACKEND")
+		seen = cookie.Value
+		w.WriteHeader(http.StatusOK)
+	})
+	validator := func(backend string) bool { return backend == "http://allowed" }
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{BackendValidator: validator})
+
+	responseWriter := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	request.Header.Set("X-Traefik-Backend", "http://allowed")
+	stickyHeader.ServeHTTP(responseWriter, request)
+
+	assert.Equal(t, "http://allowed", seen)
+}
+
+func TestStickyHeaderRejectsForgedBackendCookie(t *testing.T) {
+	var sawCookie string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie("_TRAEFIK_BACKEND"); err == nil {
+			sawCookie = cookie.Value
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	validator := func(backend string) bool { return backend == "http://allowed" }
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{BackendValidator: validator})
+
+	responseWriter := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	request.AddCookie(&http.Cookie{Name: cookieName, Value: "http://internal-secret-9200"})
+	stickyHeader.ServeHTTP(responseWriter, request)
+
+	assert.Equal(t, "", sawCookie, "a forged sticky cookie must go through BackendValidator like every other source")
+}
+
+func TestSelectBackendPinsBackendAheadOfDispatch(t *testing.T) {
+	var seen string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, _ := r.Cookie("_TRAEFIK_BACKEND")
+		seen = cookie.Value
+		w.WriteHeader(http.StatusOK)
+	})
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{})
+
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	err := stickyHeader.SelectBackend(request, "http://1.2.3.4")
+	assert.NoError(t, err)
+
+	responseWriter := httptest.NewRecorder()
+	stickyHeader.ServeHTTP(responseWriter, request)
+
+	assert.Equal(t, "http://1.2.3.4", seen)
+}
+
+func TestSelectBackendPinsBackendWhenTokenModeEnabled(t *testing.T) {
+	var seen string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, _ := r.Cookie("_TRAEFIK_BACKEND")
+		seen = cookie.Value
+		w.WriteHeader(http.StatusOK)
+	})
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{Salt: "secret"})
+
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	err := stickyHeader.SelectBackend(request, "http://1.2.3.4")
+	assert.NoError(t, err)
+
+	responseWriter := httptest.NewRecorder()
+	stickyHeader.ServeHTTP(responseWriter, request)
+
+	assert.Equal(t, "http://1.2.3.4", seen, "resolveIncomingCookie must be able to resolve the cookie SelectBackend just pinned, not treat it as a forged raw URL and strip it")
+}
+
+func TestSelectBackendRejectsBackendOutsidePool(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	validator := func(backend string) bool { return backend == "http://allowed" }
+	stickyHeader := NewStickyHeader(handler, StickyHeaderConfig{BackendValidator: validator})
+
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	err := stickyHeader.SelectBackend(request, "http://not-allowed")
+	assert.Error(t, err)
+}
+
 func getResponseCookieByName(response *http.Response, name string) string {
 	for _, cookie := range response.Cookies() {
 		if name == cookie.Name {
@@ -0,0 +1,317 @@
+package middlewares
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StickySessionConfig configures a StickySession middleware. It is intended
+// to be embedded as Frontend.StickySession in the frontend configuration,
+// alongside the existing Frontend.PassHostHeader-style options, but no such
+// Frontend type exists in this tree yet: nothing currently constructs a
+// StickySession from parsed configuration, so it is unreachable from any
+// entrypoint until that wiring is added.
+type StickySessionConfig struct {
+	// CookieName names the cookie used by the "cookie" store. Defaults to
+	// "_TRAEFIK_BACKEND" when empty.
+	CookieName string
+	// HeaderName names the header used by the "header-token" store.
+	// Defaults to "X-Traefik-Backend" when empty.
+	HeaderName string
+	// Mode selects the backing Store: StoreModeCookie or
+	// StoreModeHeaderToken. Defaults to StoreModeCookie.
+	Mode string
+	// Salt signs tokens issued by the "header-token" store.
+	Salt string
+	// Paths lists the scopes sticky assignments can be pinned to
+	// independently, e.g. []string{"/socket.io/", "/"}. Longer paths take
+	// precedence when a request matches more than one. Defaults to
+	// []string{"/"} when empty.
+	Paths []string
+	// TTL is how long a sticky assignment stays valid. Zero means the
+	// assignment lives for the lifetime of the underlying cookie/token
+	// (i.e. a session cookie, no Max-Age).
+	TTL time.Duration
+}
+
+const (
+	// StoreModeCookie backs sticky assignments with a Set-Cookie/Cookie pair.
+	StoreModeCookie = "cookie"
+	// StoreModeHeaderToken backs sticky assignments with a signed token
+	// carried in a request/response header, for CORS/XHR clients that can't
+	// persist cookies across subdomains.
+	StoreModeHeaderToken = "header-token"
+)
+
+// StoreOptions carries the per-assignment parameters a Store.Set call needs.
+type StoreOptions struct {
+	// Path scopes the assignment, e.g. "/" or "/socket.io/".
+	Path string
+	// TTL overrides the store's default TTL for this assignment. Zero uses
+	// the store's default.
+	TTL time.Duration
+}
+
+// Store is a pluggable sticky-session backend. Implementations decide how a
+// backend assignment travels between client and Traefik.
+type Store interface {
+	// Get returns the backend pinned for req, if any.
+	Get(req *http.Request) (backend string, ok bool)
+	// Set pins backend for future requests matching opts.Path.
+	Set(w http.ResponseWriter, backend string, opts StoreOptions)
+	// Delete clears any assignment for the given scope (e.g. a Path).
+	Delete(w http.ResponseWriter, scope string)
+}
+
+// Rule lets operators react to sticky-session events without recompiling
+// Traefik, in the spirit of bouncer's cookie rewriter hooks. Either callback
+// may be nil.
+type Rule struct {
+	// OnRequest runs before the request reaches the next handler. It can
+	// inspect or rewrite req (e.g. to pin a backend based on a header set
+	// by an earlier middleware).
+	OnRequest func(req *http.Request)
+	// OnResponse runs once, when the wrapped handler writes its status
+	// line. backend is the backend the active Store reports for the
+	// incoming request ("" if none); return a non-empty pin to persist it
+	// for the request's path scope with the given ttl, e.g. "if response
+	// sets cookie X, also pin backend to this instance for 10 minutes".
+	OnResponse func(w http.ResponseWriter, req *http.Request, backend string) (pin string, ttl time.Duration)
+}
+
+// StickySession is a middleware that pins requests to a backend using a
+// pluggable Store, with per-path scoping and optional TTLs. It supersedes
+// the hardcoded /socket.io/ path handling that StickyHeader carries for
+// backwards compatibility.
+type StickySession struct {
+	next  http.Handler
+	store Store
+	paths []string
+	rules []Rule
+}
+
+// NewStickySession builds a StickySession middleware from config, wrapping
+// next. The returned Store is also returned so callers (e.g. tests, or
+// other middlewares wanting to pin a backend) can drive it directly.
+func NewStickySession(next http.Handler, config StickySessionConfig) (*StickySession, Store) {
+	paths := config.Paths
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	// Longest path first, so matchPath prefers the most specific scope.
+	sort.Slice(paths, func(i, j int) bool { return len(paths[i]) > len(paths[j]) })
+
+	var store Store
+	switch config.Mode {
+	case StoreModeHeaderToken:
+		header := config.HeaderName
+		if header == "" {
+			header = headerName
+		}
+		store = &headerTokenStore{headerName: header, salt: config.Salt, ttl: config.TTL}
+	default:
+		cookie := config.CookieName
+		if cookie == "" {
+			cookie = cookieName
+		}
+		store = &cookieStore{cookieName: cookie, ttl: config.TTL}
+	}
+
+	return &StickySession{next: next, store: store, paths: paths}, store
+}
+
+// AddRule registers a rule-engine hook that runs on every request/response
+// pair handled by this middleware.
+func (s *StickySession) AddRule(rule Rule) {
+	s.rules = append(s.rules, rule)
+}
+
+func (s *StickySession) matchPath(reqPath string) string {
+	for _, p := range s.paths {
+		if strings.HasPrefix(reqPath, p) {
+			return p
+		}
+	}
+	return "/"
+}
+
+func (s *StickySession) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	for _, rule := range s.rules {
+		if rule.OnRequest != nil {
+			rule.OnRequest(req)
+		}
+	}
+
+	writer := &stickySessionWriter{ResponseWriter: w, session: s, req: req, scope: s.matchPath(req.URL.Path)}
+	s.next.ServeHTTP(writer, req)
+}
+
+// stickySessionWriter runs the response-side rule hooks once the wrapped
+// handler is about to write its status line. The actual sticky assignment
+// is made elsewhere, by whatever component decides the backend (e.g. the
+// load balancer) calling Store.Set directly.
+type stickySessionWriter struct {
+	http.ResponseWriter
+	session     *StickySession
+	req         *http.Request
+	scope       string
+	wroteHeader bool
+}
+
+func (w *stickySessionWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+
+		backend, _ := w.session.store.Get(w.req)
+		for _, rule := range w.session.rules {
+			if rule.OnResponse == nil {
+				continue
+			}
+			if pin, ttl := rule.OnResponse(w.ResponseWriter, w.req, backend); pin != "" {
+				w.session.store.Set(w.ResponseWriter, pin, StoreOptions{Path: w.scope, TTL: ttl})
+			}
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write runs the response-side hooks via WriteHeader when the handler writes
+// a body without setting a status first.
+func (w *stickySessionWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// cookieStore is the default Store: it persists the sticky assignment as a
+// cookie, scoped per Path, with an optional TTL reflected as Expires/Max-Age.
+type cookieStore struct {
+	cookieName string
+	ttl        time.Duration
+}
+
+// Get returns the first matching cookie. Per-path scoping relies on the
+// user agent only sending the cookie whose Path matches the request URL in
+// the first place, the same way browsers scope any other cookie.
+func (s *cookieStore) Get(req *http.Request) (string, bool) {
+	cookie, err := req.Cookie(s.cookieName)
+	if err != nil {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+func (s *cookieStore) Set(w http.ResponseWriter, backend string, opts StoreOptions) {
+	path := opts.Path
+	if path == "" {
+		path = "/"
+	}
+	ttl := opts.TTL
+	if ttl == 0 {
+		ttl = s.ttl
+	}
+
+	cookie := &http.Cookie{Name: s.cookieName, Value: backend, Path: path}
+	if ttl > 0 {
+		cookie.MaxAge = int(ttl.Seconds())
+		cookie.Expires = time.Now().Add(ttl)
+	}
+	http.SetCookie(w, cookie)
+}
+
+func (s *cookieStore) Delete(w http.ResponseWriter, scope string) {
+	if scope == "" {
+		scope = "/"
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:    s.cookieName,
+		Value:   "",
+		Path:    scope,
+		MaxAge:  0,
+		Expires: time.Now().Add(-100 * time.Hour),
+	})
+}
+
+// headerTokenStore backs sticky assignments with a signed token carried in a
+// request/response header instead of a cookie, for XHR/CORS clients that
+// cannot rely on cookies persisting across subdomains.
+type headerTokenStore struct {
+	headerName string
+	salt       string
+	ttl        time.Duration
+}
+
+func (s *headerTokenStore) Get(req *http.Request) (string, bool) {
+	return s.verify(req.Header.Get(s.headerName))
+}
+
+func (s *headerTokenStore) Set(w http.ResponseWriter, backend string, opts StoreOptions) {
+	ttl := opts.TTL
+	if ttl == 0 {
+		ttl = s.ttl
+	}
+	w.Header().Set(s.headerName, s.sign(backend, ttl))
+}
+
+func (s *headerTokenStore) Delete(w http.ResponseWriter, scope string) {
+	w.Header().Del(s.headerName)
+}
+
+// sign embeds an expiry (0 meaning "never") alongside backend in the signed
+// payload, so a verifier with no shared state can still reject a token whose
+// ttl has elapsed.
+func (s *headerTokenStore) sign(backend string, ttl time.Duration) string {
+	var expiresAt int64
+	if ttl != 0 {
+		expiresAt = time.Now().Add(ttl).Unix()
+	}
+	payload := base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(expiresAt, 10) + "|" + backend))
+	mac := hmac.New(sha256.New, []byte(s.salt))
+	mac.Write([]byte(payload))
+	sig := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	return payload + "." + sig
+}
+
+func (s *headerTokenStore) verify(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.salt))
+	mac.Write([]byte(parts[0]))
+	expected := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(parts[1])) {
+		return "", false
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+
+	expiry, backend, ok := strings.Cut(string(decoded), "|")
+	if !ok {
+		return "", false
+	}
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return "", false
+	}
+	if expiresAt != 0 && time.Now().Unix() > expiresAt {
+		return "", false
+	}
+
+	return backend, true
+}
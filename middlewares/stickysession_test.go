@@ -0,0 +1,162 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCookieStoreSetAndGetRoundTrip(t *testing.T) {
+	store := &cookieStore{cookieName: "_TRAEFIK_BACKEND"}
+	responseWriter := httptest.NewRecorder()
+
+	store.Set(responseWriter, "http://1.2.3.4", StoreOptions{Path: "/"})
+
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	for _, cookie := range responseWriter.Result().Cookies() {
+		request.AddCookie(cookie)
+	}
+
+	backend, ok := store.Get(request)
+	assert.True(t, ok)
+	assert.Equal(t, "http://1.2.3.4", backend)
+}
+
+func TestCookieStoreSetAppliesTTLAsMaxAge(t *testing.T) {
+	store := &cookieStore{cookieName: "_TRAEFIK_BACKEND"}
+	responseWriter := httptest.NewRecorder()
+
+	store.Set(responseWriter, "http://1.2.3.4", StoreOptions{Path: "/", TTL: 10 * time.Minute})
+
+	cookies := responseWriter.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.Equal(t, 600, cookies[0].MaxAge)
+}
+
+func TestCookieStorePerPathIsolation(t *testing.T) {
+	store := &cookieStore{cookieName: "_TRAEFIK_BACKEND"}
+
+	socketIOWriter := httptest.NewRecorder()
+	store.Set(socketIOWriter, "http://1.2.3.4", StoreOptions{Path: "/socket.io/"})
+
+	rootWriter := httptest.NewRecorder()
+	store.Set(rootWriter, "http://5.6.7.8", StoreOptions{Path: "/"})
+
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	for _, cookie := range socketIOWriter.Result().Cookies() {
+		request.AddCookie(cookie)
+	}
+	for _, cookie := range rootWriter.Result().Cookies() {
+		request.AddCookie(cookie)
+	}
+
+	// Both cookies share a name but differ in Path. A request cookie carries
+	// no Path, so Get cannot tell the scopes apart here; this checks that
+	// both assignments survive the round trip as distinct cookies.
+	cookies := request.Cookies()
+	assert.Len(t, cookies, 2)
+}
+
+func TestHeaderTokenStoreSetAndGetRoundTrip(t *testing.T) {
+	store := &headerTokenStore{headerName: "X-Traefik-Backend", salt: "secret"}
+	responseWriter := httptest.NewRecorder()
+
+	store.Set(responseWriter, "http://1.2.3.4", StoreOptions{})
+
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	request.Header.Set("X-Traefik-Backend", responseWriter.Header().Get("X-Traefik-Backend"))
+
+	backend, ok := store.Get(request)
+	assert.True(t, ok)
+	assert.Equal(t, "http://1.2.3.4", backend)
+}
+
+func TestHeaderTokenStoreRejectsTamperedToken(t *testing.T) {
+	store := &headerTokenStore{headerName: "X-Traefik-Backend", salt: "secret"}
+	responseWriter := httptest.NewRecorder()
+	store.Set(responseWriter, "http://1.2.3.4", StoreOptions{})
+
+	token := responseWriter.Header().Get("X-Traefik-Backend") + "tampered"
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	request.Header.Set("X-Traefik-Backend", token)
+
+	_, ok := store.Get(request)
+	assert.False(t, ok)
+}
+
+func TestHeaderTokenStoreRejectsWrongSalt(t *testing.T) {
+	issuer := &headerTokenStore{headerName: "X-Traefik-Backend", salt: "secret"}
+	verifier := &headerTokenStore{headerName: "X-Traefik-Backend", salt: "different"}
+
+	responseWriter := httptest.NewRecorder()
+	issuer.Set(responseWriter, "http://1.2.3.4", StoreOptions{})
+
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	request.Header.Set("X-Traefik-Backend", responseWriter.Header().Get("X-Traefik-Backend"))
+
+	_, ok := verifier.Get(request)
+	assert.False(t, ok)
+}
+
+func TestHeaderTokenStoreRejectsExpiredToken(t *testing.T) {
+	store := &headerTokenStore{headerName: "X-Traefik-Backend", salt: "secret"}
+	responseWriter := httptest.NewRecorder()
+
+	store.Set(responseWriter, "http://1.2.3.4", StoreOptions{TTL: -1 * time.Minute})
+
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	request.Header.Set("X-Traefik-Backend", responseWriter.Header().Get("X-Traefik-Backend"))
+
+	_, ok := store.Get(request)
+	assert.False(t, ok)
+}
+
+func TestHeaderTokenStoreDefaultTTLAppliesWhenOptsTTLIsZero(t *testing.T) {
+	store := &headerTokenStore{headerName: "X-Traefik-Backend", salt: "secret", ttl: -1 * time.Minute}
+	responseWriter := httptest.NewRecorder()
+
+	store.Set(responseWriter, "http://1.2.3.4", StoreOptions{})
+
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	request.Header.Set("X-Traefik-Backend", responseWriter.Header().Get("X-Traefik-Backend"))
+
+	_, ok := store.Get(request)
+	assert.False(t, ok, "store's own ttl should apply when opts.TTL is unset")
+}
+
+func TestStickySessionMatchPathPrefersLongestScope(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	session, _ := NewStickySession(handler, StickySessionConfig{Paths: []string{"/", "/socket.io/"}})
+
+	assert.Equal(t, "/socket.io/", session.matchPath("/socket.io/xhr"))
+	assert.Equal(t, "/", session.matchPath("/api/widgets"))
+}
+
+func TestStickySessionRuleOnResponsePinsBackend(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	session, store := NewStickySession(handler, StickySessionConfig{})
+	session.AddRule(Rule{
+		OnResponse: func(w http.ResponseWriter, req *http.Request, backend string) (string, time.Duration) {
+			return "http://1.2.3.4", 10 * time.Minute
+		},
+	})
+
+	responseWriter := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://example.com", nil)
+	session.ServeHTTP(responseWriter, request)
+
+	replay, _ := http.NewRequest("GET", "http://example.com", nil)
+	for _, cookie := range responseWriter.Result().Cookies() {
+		replay.AddCookie(cookie)
+	}
+	backend, ok := store.Get(replay)
+	assert.True(t, ok)
+	assert.Equal(t, "http://1.2.3.4", backend)
+}